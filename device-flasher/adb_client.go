@@ -0,0 +1,276 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/gousb"
+)
+
+// ADB's USB class/subclass/protocol, as advertised by the adbd gadget.
+const (
+	adbClass    = 0xff
+	adbSubclass = 0x42
+	adbProtocol = 0x01
+
+	adbMaxPayload = 256 * 1024
+)
+
+// ADB packet commands, see system/core/adb/protocol.txt.
+const (
+	aCnxn = 0x4e584e43
+	aAuth = 0x48545541
+	aOpen = 0x4e45504f
+	aOkay = 0x59414b4f
+	aClse = 0x45534c43
+	aWrte = 0x45545257
+)
+
+const adbVersion = 0x01000000
+
+// errAdbAuthRequired marks connect's A_AUTH error so getDevicesNative can
+// recognize it with errors.Is and surface it instead of letting the device
+// vanish silently when it falls through to fastboot detection.
+var errAdbAuthRequired = errors.New("adb: device requested RSA key authentication, which this client does not implement")
+
+// adbPacket is ADB's 24-byte wire header followed by an optional payload.
+type adbPacket struct {
+	Command    uint32
+	Arg0       uint32
+	Arg1       uint32
+	DataLength uint32
+	DataCheck  uint32
+	Magic      uint32
+	Payload    []byte
+}
+
+func newAdbPacket(command, arg0, arg1 uint32, payload []byte) adbPacket {
+	return adbPacket{
+		Command:    command,
+		Arg0:       arg0,
+		Arg1:       arg1,
+		DataLength: uint32(len(payload)),
+		DataCheck:  adbChecksum(payload),
+		Magic:      command ^ 0xffffffff,
+		Payload:    payload,
+	}
+}
+
+func adbChecksum(data []byte) uint32 {
+	var sum uint32
+	for _, b := range data {
+		sum += uint32(b)
+	}
+	return sum
+}
+
+func (p adbPacket) marshalHeader() []byte {
+	buf := make([]byte, 24)
+	binary.LittleEndian.PutUint32(buf[0:], p.Command)
+	binary.LittleEndian.PutUint32(buf[4:], p.Arg0)
+	binary.LittleEndian.PutUint32(buf[8:], p.Arg1)
+	binary.LittleEndian.PutUint32(buf[12:], p.DataLength)
+	binary.LittleEndian.PutUint32(buf[16:], p.DataCheck)
+	binary.LittleEndian.PutUint32(buf[20:], p.Magic)
+	return buf
+}
+
+func unmarshalAdbHeader(buf []byte) adbPacket {
+	return adbPacket{
+		Command:    binary.LittleEndian.Uint32(buf[0:]),
+		Arg0:       binary.LittleEndian.Uint32(buf[4:]),
+		Arg1:       binary.LittleEndian.Uint32(buf[8:]),
+		DataLength: binary.LittleEndian.Uint32(buf[12:]),
+		DataCheck:  binary.LittleEndian.Uint32(buf[16:]),
+		Magic:      binary.LittleEndian.Uint32(buf[20:]),
+	}
+}
+
+// adbClient speaks the ADB USB transport directly: A_CNXN handshake followed
+// by A_OPEN/A_WRTE/A_OKAY/A_CLSE framing for a single "shell,raw:<cmd>"
+// stream, which is all the flasher needs to read device properties.
+type adbClient struct {
+	usbCtx *gousb.Context
+	device *gousb.Device
+	cfg    *gousb.Config
+	intf   *gousb.Interface
+	in     *gousb.InEndpoint
+	out    *gousb.OutEndpoint
+	serial string
+
+	localID uint32
+}
+
+func openAdbDevice(serial string) (*adbClient, error) {
+	ctx := gousb.NewContext()
+	devices, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool { return true })
+	if err != nil {
+		ctx.Close()
+		return nil, err
+	}
+	for _, dev := range devices {
+		cfg, err := dev.Config(1)
+		if err != nil {
+			dev.Close()
+			continue
+		}
+		for _, ifDesc := range cfg.Desc.Interfaces {
+			for _, alt := range ifDesc.AltSettings {
+				if alt.Class != adbClass || alt.SubClass != adbSubclass || alt.Protocol != adbProtocol {
+					continue
+				}
+				devSerial, err := dev.SerialNumber()
+				if err != nil || (serial != "" && devSerial != serial) {
+					continue
+				}
+				intf, err := cfg.Interface(ifDesc.Number, alt.Number)
+				if err != nil {
+					continue
+				}
+				var in *gousb.InEndpoint
+				var out *gousb.OutEndpoint
+				for _, epDesc := range alt.Endpoints {
+					if epDesc.Direction == gousb.EndpointDirectionIn {
+						in, _ = intf.InEndpoint(epDesc.Number)
+					} else {
+						out, _ = intf.OutEndpoint(epDesc.Number)
+					}
+				}
+				if in == nil || out == nil {
+					intf.Close()
+					continue
+				}
+				client := &adbClient{usbCtx: ctx, device: dev, cfg: cfg, intf: intf, in: in, out: out, serial: devSerial, localID: 1}
+				if err := client.connect(); err != nil {
+					client.Close()
+					return nil, err
+				}
+				return client, nil
+			}
+		}
+		_ = cfg.Close()
+		dev.Close()
+	}
+	ctx.Close()
+	return nil, fmt.Errorf("no adb device found for serial %q", serial)
+}
+
+func (c *adbClient) Close() {
+	if c.intf != nil {
+		c.intf.Close()
+	}
+	if c.cfg != nil {
+		_ = c.cfg.Close()
+	}
+	if c.device != nil {
+		c.device.Close()
+	}
+	if c.usbCtx != nil {
+		c.usbCtx.Close()
+	}
+}
+
+func (c *adbClient) send(p adbPacket) error {
+	if _, err := c.out.Write(p.marshalHeader()); err != nil {
+		return err
+	}
+	if len(p.Payload) > 0 {
+		if _, err := c.out.Write(p.Payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *adbClient) recv() (adbPacket, error) {
+	header := make([]byte, 24)
+	if _, err := c.in.Read(header); err != nil {
+		return adbPacket{}, err
+	}
+	p := unmarshalAdbHeader(header)
+	if p.DataLength > 0 {
+		p.Payload = make([]byte, p.DataLength)
+		if _, err := c.in.Read(p.Payload); err != nil {
+			return adbPacket{}, err
+		}
+	}
+	return p, nil
+}
+
+func (c *adbClient) connect() error {
+	banner := []byte(fmt.Sprintf("host::features=shell_v2,cmd\x00"))
+	if err := c.send(newAdbPacket(aCnxn, adbVersion, adbMaxPayload, banner)); err != nil {
+		return err
+	}
+	reply, err := c.recv()
+	if err != nil {
+		return err
+	}
+	if reply.Command == aAuth {
+		return fmt.Errorf("%w; authorize this host with the official adb client first (adb -s %s shell true), or pass -legacy-tools to shell out to it", errAdbAuthRequired, c.serial)
+	}
+	if reply.Command != aCnxn {
+		return fmt.Errorf("adb: expected CNXN, got %#x", reply.Command)
+	}
+	return nil
+}
+
+// Shell runs cmd on the device and returns its combined stdout/stderr, using
+// a single A_OPEN/A_WRTE/A_CLSE exchange.
+func (c *adbClient) Shell(cmd string) (string, error) {
+	localID := c.localID
+	c.localID++
+	destination := append([]byte("shell,raw:"+cmd), 0)
+	if err := c.send(newAdbPacket(aOpen, localID, 0, destination)); err != nil {
+		return "", err
+	}
+	var remoteID uint32
+	var output strings.Builder
+	for {
+		p, err := c.recv()
+		if err != nil {
+			return output.String(), err
+		}
+		switch p.Command {
+		case aOkay:
+			remoteID = p.Arg0
+		case aWrte:
+			output.Write(p.Payload)
+			if err := c.send(newAdbPacket(aOkay, localID, p.Arg0, nil)); err != nil {
+				return output.String(), err
+			}
+		case aClse:
+			_ = remoteID
+			return output.String(), nil
+		}
+	}
+}
+
+// RebootBootloader requests the device reboot into fastboot mode.
+func (c *adbClient) RebootBootloader() error {
+	localID := c.localID
+	c.localID++
+	destination := append([]byte("reboot:bootloader"), 0)
+	if err := c.send(newAdbPacket(aOpen, localID, 0, destination)); err != nil {
+		return err
+	}
+	_, err := c.recv()
+	return err
+}
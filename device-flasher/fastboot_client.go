@@ -0,0 +1,275 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/gousb"
+)
+
+// Fastboot's USB class/subclass/protocol, as advertised by bootloaders.
+const (
+	fastbootClass    = 0xff
+	fastbootSubclass = 0x42
+	fastbootProtocol = 0x03
+
+	fastbootMaxPacketSize = 16384
+)
+
+// fastbootClient speaks the fastboot USB protocol directly over bulk
+// endpoints, without shelling out to the fastboot binary. Every command is
+// an ASCII string; every response begins with a 4-byte prefix:
+//
+//	OKAY<msg> - command succeeded, msg may be empty
+//	FAIL<msg> - command failed, msg is a human-readable reason
+//	DATA<hex8> - the device wants to send/receive <hex8> bytes of data
+//	INFO<msg> - informational text, more responses follow
+type fastbootClient struct {
+	usbCtx *gousb.Context
+	device *gousb.Device
+	cfg    *gousb.Config
+	intf   *gousb.Interface
+	in     *gousb.InEndpoint
+	out    *gousb.OutEndpoint
+	serial string
+
+	// reporter, when set via WithReporter, receives INFO responses instead
+	// of them going to stdout directly, which would otherwise scroll through
+	// and corrupt a TUIReporter's in-place dashboard redraw.
+	reporter Reporter
+}
+
+// WithReporter attaches reporter so c's INFO responses are surfaced through
+// it rather than printed directly. Callers that open a client before a
+// Reporter exists (e.g. device detection) can leave this unset, in which
+// case command falls back to printing INFO text as before.
+func (c *fastbootClient) WithReporter(reporter Reporter) *fastbootClient {
+	c.reporter = reporter
+	return c
+}
+
+func openFastbootDevice(serial string) (*fastbootClient, error) {
+	ctx := gousb.NewContext()
+	devices, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
+		return true
+	})
+	if err != nil {
+		ctx.Close()
+		return nil, err
+	}
+	for _, dev := range devices {
+		cfg, err := dev.Config(1)
+		if err != nil {
+			dev.Close()
+			continue
+		}
+		for _, ifDesc := range cfg.Desc.Interfaces {
+			for _, alt := range ifDesc.AltSettings {
+				if alt.Class != fastbootClass || alt.SubClass != fastbootSubclass || alt.Protocol != fastbootProtocol {
+					continue
+				}
+				devSerial, err := dev.SerialNumber()
+				if err != nil || (serial != "" && devSerial != serial) {
+					continue
+				}
+				intf, err := cfg.Interface(ifDesc.Number, alt.Number)
+				if err != nil {
+					continue
+				}
+				var in *gousb.InEndpoint
+				var out *gousb.OutEndpoint
+				for _, epDesc := range alt.Endpoints {
+					if epDesc.Direction == gousb.EndpointDirectionIn {
+						in, _ = intf.InEndpoint(epDesc.Number)
+					} else {
+						out, _ = intf.OutEndpoint(epDesc.Number)
+					}
+				}
+				if in == nil || out == nil {
+					intf.Close()
+					continue
+				}
+				return &fastbootClient{usbCtx: ctx, device: dev, cfg: cfg, intf: intf, in: in, out: out, serial: devSerial}, nil
+			}
+		}
+		_ = cfg.Close()
+		dev.Close()
+	}
+	ctx.Close()
+	return nil, fmt.Errorf("no fastboot device found for serial %q", serial)
+}
+
+func (c *fastbootClient) Close() {
+	if c.intf != nil {
+		c.intf.Close()
+	}
+	if c.cfg != nil {
+		_ = c.cfg.Close()
+	}
+	if c.device != nil {
+		c.device.Close()
+	}
+	if c.usbCtx != nil {
+		c.usbCtx.Close()
+	}
+}
+
+// response is the parsed form of one fastboot protocol reply.
+type response struct {
+	Status string // OKAY, FAIL, DATA or INFO
+	Body   string
+}
+
+func (c *fastbootClient) readResponse() (response, error) {
+	buf := make([]byte, 64)
+	n, err := c.in.Read(buf)
+	if err != nil {
+		return response{}, err
+	}
+	if n < 4 {
+		return response{}, errors.New("fastboot: short response")
+	}
+	return response{Status: string(buf[:4]), Body: string(buf[4:n])}, nil
+}
+
+// command sends a single fastboot command and returns its final OKAY text or,
+// when that is empty, the INFO lines that preceded it joined by newlines, or
+// an error if the device replied FAIL.
+func (c *fastbootClient) command(cmd string) (string, error) {
+	if _, err := c.out.Write([]byte(cmd)); err != nil {
+		return "", err
+	}
+	var info []string
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return "", err
+		}
+		switch resp.Status {
+		case "OKAY":
+			if resp.Body == "" && len(info) > 0 {
+				return strings.Join(info, "\n"), nil
+			}
+			return resp.Body, nil
+		case "FAIL":
+			return "", fmt.Errorf("fastboot: %s", resp.Body)
+		case "INFO":
+			info = append(info, resp.Body)
+			if c.reporter != nil {
+				c.reporter.Warn(c.serial, resp.Body)
+			} else {
+				fmt.Println(resp.Body)
+			}
+		default:
+			return "", fmt.Errorf("fastboot: unexpected response %q", resp.Status)
+		}
+	}
+}
+
+func (c *fastbootClient) GetVar(prop string) (string, error) {
+	return c.command("getvar:" + prop)
+}
+
+func (c *fastbootClient) FlashingUnlock() error {
+	_, err := c.command("flashing unlock")
+	return err
+}
+
+func (c *fastbootClient) FlashingUnlockCritical() error {
+	_, err := c.command("flashing unlock_critical")
+	return err
+}
+
+func (c *fastbootClient) FlashingGetUnlockAbility() (string, error) {
+	return c.command("flashing get_unlock_ability")
+}
+
+func (c *fastbootClient) OemDeviceInfo() (string, error) {
+	return c.command("oem device-info")
+}
+
+func (c *fastbootClient) Reboot() error {
+	_, err := c.command("reboot")
+	return err
+}
+
+func (c *fastbootClient) SetActive(slot string) error {
+	_, err := c.command("set_active:" + slot)
+	return err
+}
+
+// Download sends data to the device's download buffer, reporting progress
+// via progress (typically a *WriteCounter or a *reporterProgressWriter) as
+// each chunk is written after the device's DATA reply.
+func (c *fastbootClient) Download(data []byte, progress io.Writer) error {
+	sizeCmd := fmt.Sprintf("download:%08x", len(data))
+	if _, err := c.out.Write([]byte(sizeCmd)); err != nil {
+		return err
+	}
+	resp, err := c.readResponse()
+	if err != nil {
+		return err
+	}
+	if resp.Status != "DATA" {
+		return fmt.Errorf("fastboot: expected DATA, got %s %s", resp.Status, resp.Body)
+	}
+	offset := 0
+	for offset < len(data) {
+		end := offset + fastbootMaxPacketSize
+		if end > len(data) {
+			end = len(data)
+		}
+		n, err := c.out.Write(data[offset:end])
+		if err != nil {
+			return err
+		}
+		offset += n
+		if progress != nil {
+			_, _ = progress.Write(data[offset-n : offset])
+		}
+	}
+	resp, err = c.readResponse()
+	if err != nil {
+		return err
+	}
+	if resp.Status != "OKAY" {
+		return fmt.Errorf("fastboot: download failed: %s", resp.Body)
+	}
+	return nil
+}
+
+// Flash downloads image to the device's download buffer, then writes it to
+// partition.
+func (c *fastbootClient) Flash(partition string, image io.Reader, size int64, progress io.Writer) error {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(image, data); err != nil {
+		return err
+	}
+	if err := c.Download(data, progress); err != nil {
+		return err
+	}
+	_, err := c.command("flash:" + partition)
+	return err
+}
+
+func (c *fastbootClient) Erase(partition string) error {
+	_, err := c.command("erase:" + partition)
+	return err
+}
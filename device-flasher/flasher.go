@@ -20,6 +20,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -33,7 +34,6 @@ import (
 	"strings"
 	"sync"
 	"time"
-	"flag"
 )
 
 var input string
@@ -51,6 +51,9 @@ var deviceFactoryFolderMap map[string]string
 // Set via flag
 var parallel bool
 
+// Set via flag
+var legacyTools bool
+
 // Set via LDFLAGS, check Makefile
 const version string = "1.0"
 
@@ -93,28 +96,36 @@ func warnln(warning interface{}) {
 
 func init() {
 	flag.BoolVar(&parallel, "parallel", false, "Flash multiple devices at the same time.")
-	flag.Parse()
+	flag.BoolVar(&legacyTools, "legacy-tools", false, "Shell out to the adb/fastboot platform-tools binaries instead of speaking the USB protocols directly.")
 }
 
 func main() {
+	flag.Parse()
 	_ = os.Remove("error.log")
 	fmt.Println("Android Factory Image Flasher version " + version)
+	applyResetState()
 	// Map device codenames to their corresponding extracted factory image folders
-	deviceFactoryFolderMap = getFactoryFolders()
+	if ota {
+		deviceFactoryFolderMap = getOtaFolders()
+	} else {
+		deviceFactoryFolderMap = getFactoryFolders()
+	}
 	if len(deviceFactoryFolderMap) < 1 {
 		errorln(errors.New("Cannot continue without a device factory image. Exiting..."), true)
 	}
-	err := getPlatformTools()
-	if err != nil {
-		errorln("Cannot continue without Android platform tools. Exiting...", false)
-		errorln(err, true)
-	}
-	platformToolCommand := *adb
-	platformToolCommand.Args = append(adb.Args, "start-server")
-	err = platformToolCommand.Run()
-	if err != nil {
-		errorln("Cannot start ADB server", false)
-		errorln(err, true)
+	if legacyTools {
+		err := getPlatformTools()
+		if err != nil {
+			errorln("Cannot continue without Android platform tools. Exiting...", false)
+			errorln(err, true)
+		}
+		platformToolCommand := *adb
+		platformToolCommand.Args = append(adb.Args, "start-server")
+		err = platformToolCommand.Run()
+		if err != nil {
+			errorln("Cannot start ADB server", false)
+			errorln(err, true)
+		}
 	}
 	warnln("1. Connect to a Wi-Fi network and ensure that no SIM cards are installed")
 	warnln("2. Enable Developer Options on device (Settings -> About Phone -> tap \"Build number\" 7 times)")
@@ -142,7 +153,7 @@ func main() {
 	fmt.Print(Warn("Press ENTER to continue"))
 	_, _ = fmt.Scanln(&input)
 	// Sequence: unlock bootloader -> execute flash-all script -> relock bootloader
-	flashDevices(devices)
+	flashDevices(devices, newReporter(devices))
 }
 
 func getFactoryFolders() map[string]string {
@@ -154,6 +165,10 @@ func getFactoryFolders() map[string]string {
 	for _, file := range files {
 		file := file.Name()
 		if strings.Contains(file, "factory") && strings.HasSuffix(file, ".zip") {
+			if err := verifyImageSignature(filepath.Join(cwd, file)); err != nil {
+				errorln("Cannot continue without a verified factory image. Exiting...", false)
+				errorln(err, true)
+			}
 			extracted, err := extractZip(path.Base(file), cwd)
 			if err != nil {
 				errorln("Cannot continue without a factory image. Exiting...", false)
@@ -176,6 +191,9 @@ func getPlatformTools() error {
 		[2]string{"linux", "33.0.3"}:   "https://dl.google.com/android/repository/platform-tools_r33.0.3-linux.zip",
 		[2]string{"windows", "33.0.3"}: "https://dl.google.com/android/repository/platform-tools_r33.0.3-windows.zip",
 	}
+	// Google doesn't publish a signed checksums file for platform-tools
+	// archives, so these are checked against a pinned sha256 per release
+	// instead of one fetched and verified at runtime.
 	platformToolsChecksumMap := map[[2]string]string{
 		[2]string{"darwin", "33.0.3"}:  "84acbbd2b2ccef159ae3e6f83137e44ad18388ff3cc66bb057c87d761744e595",
 		[2]string{"linux", "33.0.3"}:   "ab885c20f1a9cb528eb145b9208f53540efa3d26258ac3ce4363570a0846f8f7",
@@ -190,7 +208,8 @@ func getPlatformTools() error {
 		}
 	}
 	platformToolsZip = path.Base(plaformToolsUrlMap[platformToolsOsVersion])
-	err = verifyZip(platformToolsZip, platformToolsChecksumMap[platformToolsOsVersion])
+	expectedSum := platformToolsChecksumMap[platformToolsOsVersion]
+	err = verifyZip(platformToolsZip, expectedSum)
 	if err != nil {
 		fmt.Println(platformToolsZip + " checksum verification failed")
 		return err
@@ -219,6 +238,13 @@ func getPlatformTools() error {
 }
 
 func getDevices() map[string]string {
+	if !legacyTools {
+		return getDevicesNative()
+	}
+	return getDevicesLegacy()
+}
+
+func getDevicesLegacy() map[string]string {
 	devices := map[string]string{}
 	for _, platformToolCommand := range []exec.Cmd{*adb, *fastboot} {
 		platformToolCommand.Args = append(platformToolCommand.Args, "devices")
@@ -255,6 +281,13 @@ func getDevices() map[string]string {
 // prop: value
 // Finished. Total time: 0.002s
 func getVar(prop string, device string) string {
+	if !legacyTools {
+		return getVarNative(prop, device)
+	}
+	return getVarLegacy(prop, device)
+}
+
+func getVarLegacy(prop string, device string) string {
 	platformToolCommand := *fastboot
 	platformToolCommand.Args = append(fastboot.Args, "-s", device, "getvar", prop)
 	out, err := platformToolCommand.CombinedOutput()
@@ -275,6 +308,13 @@ func getVar(prop string, device string) string {
 // OKAY [  0.000s]
 // Finished. Total time: 0.000s
 func getUnlockAbility(device string) string {
+	if !legacyTools {
+		return getUnlockAbilityNative(device)
+	}
+	return getUnlockAbilityLegacy(device)
+}
+
+func getUnlockAbilityLegacy(device string) string {
 	platformToolCommand := *fastboot
 	platformToolCommand.Args = append(fastboot.Args, "-s", device, "flashing", "get_unlock_ability")
 	out, err := platformToolCommand.CombinedOutput()
@@ -321,6 +361,13 @@ func isNotUnlocked(serialNumber string, device string) bool {
 // OKAY [  0.000s]
 // Finished. Total time: 0.000s
 func getCriticalUnlocked(device string) string {
+	if !legacyTools {
+		return getCriticalUnlockedNative(device)
+	}
+	return getCriticalUnlockedLegacy(device)
+}
+
+func getCriticalUnlockedLegacy(device string) string {
 	platformToolCommand := *fastboot
 	platformToolCommand.Args = append(fastboot.Args, "-s", device, "oem", "device-info")
 	out, err := platformToolCommand.CombinedOutput()
@@ -337,6 +384,13 @@ func getCriticalUnlocked(device string) string {
 }
 
 func getProp(prop string, device string) string {
+	if !legacyTools {
+		return getPropNative(prop, device)
+	}
+	return getPropLegacy(prop, device)
+}
+
+func getPropLegacy(prop string, device string) string {
 	platformToolCommand := *adb
 	platformToolCommand.Args = append(adb.Args, "-s", device, "shell", "getprop", prop)
 	out, err := platformToolCommand.Output()
@@ -346,99 +400,155 @@ func getProp(prop string, device string) string {
 	return strings.Trim(string(out), "[]\n\r")
 }
 
-func flashDevices(devices map[string]string) {
+func flashDevices(devices map[string]string, reporter Reporter) {
 	var wg sync.WaitGroup
 	for serialNumber, device := range devices {
 		wg.Add(1)
 		go func(serialNumber, device string) {
 			defer wg.Done()
-			platformToolCommand := *adb
-			platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "reboot", "bootloader")
-			_ = platformToolCommand.Run()
-			fmt.Println("Unlocking " + device + " " + serialNumber + " bootloader...")
-			warnln("5. Please use the volume and power keys on the device to unlock the bootloader")
-			if device == "FP4" || device == "FP5" || device == "axolotl" || device == "otter" {
-				fmt.Println()
-				warnln("  5a. Once " + device + " " + serialNumber + " boots, disconnect its cable and power it off")
-				if device == "axolotl" || device == "otter" {
-					warnln("  5b. Then, hold volume up and connect the cable again to boot it into fastboot mode.")
-				} else {
-					warnln("  5b. Then, hold volume down and connect the cable again to boot it into fastboot mode.")
-				}
-				fmt.Println("The installation will resume automatically")
+			factoryImageHash, err := factoryImageSHA256(device)
+			if err != nil {
+				reporter.Warn(serialNumber, "could not hash factory image for resume checkpointing: "+err.Error())
 			}
-			for i := 0; isNotUnlocked(serialNumber, device); i++ {
-				platformToolCommand = *fastboot
-				platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "flashing", "unlock")
-				_ = platformToolCommand.Start()
-				time.Sleep(30 * time.Second)
-				if i >= 5 {
-					errorln("Failed to unlock "+device+" "+serialNumber+" bootloader", true)
-					return
-				}
+			resumeFrom := reconcileState(serialNumber, device, factoryImageHash)
+
+			var platformToolCommand exec.Cmd
+			if legacyTools {
+				platformToolCommand = *adb
+				platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "reboot", "bootloader")
+				_ = platformToolCommand.Run()
+			} else if client, err := openAdbDevice(serialNumber); err == nil {
+				_ = client.RebootBootloader()
+				client.Close()
 			}
-			if device == "FP4" || device == "FP5" || device == "otter" {
-				for i := 0; getCriticalUnlocked(serialNumber) != "true"; i++ {
-					fmt.Println("Unlocking (critical) " + device + " " + serialNumber + " bootloader...")
-					warnln("5.1. Please use the volume and power keys on the device to unlock the bootloader (critical)")
-					fmt.Println()
-					platformToolCommand = *fastboot
-					platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "flashing", "unlock_critical")
-					_ = platformToolCommand.Start()
+			reporter.StageChanged(serialNumber, StageUnlock)
+			if stepIndex(resumeFrom) < stepIndex(StepUnlocked) {
+				reporter.Warn(serialNumber, "Please use the volume and power keys on the device to unlock the bootloader")
+				if device == "FP4" || device == "FP5" || device == "axolotl" || device == "otter" {
+					if device == "axolotl" || device == "otter" {
+						reporter.Warn(serialNumber, "Once it boots, disconnect its cable, power it off, then hold volume up and connect the cable again to boot it into fastboot mode. The installation will resume automatically")
+					} else {
+						reporter.Warn(serialNumber, "Once it boots, disconnect its cable, power it off, then hold volume down and connect the cable again to boot it into fastboot mode. The installation will resume automatically")
+					}
+				}
+				for i := 0; isNotUnlocked(serialNumber, device); i++ {
+					if legacyTools {
+						platformToolCommand = *fastboot
+						platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "flashing", "unlock")
+						_ = platformToolCommand.Start()
+					} else if client, err := openFastbootDevice(serialNumber); err == nil {
+						_ = client.WithReporter(reporter).FlashingUnlock()
+						client.Close()
+					}
 					time.Sleep(30 * time.Second)
-					if i >= 2 {
-						errorln("Failed to unlock (critical) "+device+" "+serialNumber+" bootloader", true)
+					if i >= 5 {
+						reporter.Fail(serialNumber, errors.New("failed to unlock bootloader"))
+						errorln("Failed to unlock "+device+" "+serialNumber+" bootloader", true)
 						return
 					}
 				}
+				_ = recordStep(serialNumber, device, factoryImageHash, StepUnlocked)
+			} else {
+				reporter.Warn(serialNumber, "Already unlocked per saved checkpoint, skipping")
+			}
+			if device == "FP4" || device == "FP5" || device == "otter" {
+				if stepIndex(resumeFrom) < stepIndex(StepCriticalUnlocked) {
+					for i := 0; getCriticalUnlocked(serialNumber) != "true"; i++ {
+						reporter.StageChanged(serialNumber, StageUnlock)
+						reporter.Warn(serialNumber, "Please use the volume and power keys on the device to unlock the bootloader (critical)")
+						if legacyTools {
+							platformToolCommand = *fastboot
+							platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "flashing", "unlock_critical")
+							_ = platformToolCommand.Start()
+						} else if client, err := openFastbootDevice(serialNumber); err == nil {
+							_ = client.WithReporter(reporter).FlashingUnlockCritical()
+							client.Close()
+						}
+						time.Sleep(30 * time.Second)
+						if i >= 2 {
+							reporter.Fail(serialNumber, errors.New("failed to unlock (critical) bootloader"))
+							errorln("Failed to unlock (critical) "+device+" "+serialNumber+" bootloader", true)
+							return
+						}
+					}
+					_ = recordStep(serialNumber, device, factoryImageHash, StepCriticalUnlocked)
+				}
 			}
-			fmt.Println("Flashing " + device + " " + serialNumber + " bootloader...")
-			flashAll := exec.Command("." + string(os.PathSeparator) + "flash-all" + func() string {
-				if OS == "windows" {
-					return ".bat"
+			reporter.StageChanged(serialNumber, StageFlashingBootloader)
+			if stepIndex(resumeFrom) < stepIndex(StepSystemFlashedSlotA) {
+				if ota {
+					if err := flashOtaPartitions(serialNumber, device, deviceFactoryFolderMap[device], factoryImageHash, resumeFrom, reporter); err != nil {
+						reporter.Fail(serialNumber, err)
+						errorln("Failed to flash "+device+" "+serialNumber, false)
+						errorln(err.Error(), false)
+						return
+					}
 				} else {
-					return ".sh"
+					flashAll := exec.Command("." + string(os.PathSeparator) + "flash-all" + func() string {
+						if OS == "windows" {
+							return ".bat"
+						} else {
+							return ".sh"
+						}
+					}())
+					flashAll.Dir = deviceFactoryFolderMap[device]
+					flashAll.Stderr = os.Stderr
+					flashAll.Stdout = os.Stdout
+					flashAll.Env = append(flashAll.Environ(), "ANDROID_SERIAL="+serialNumber)
+					flashAll.Env = append(flashAll.Environ(), "DEVICE_FLASHER_VERSION="+version)
+					err := flashAll.Run()
+					if err != nil {
+						reporter.Fail(serialNumber, err)
+						errorln("Failed to flash "+device+" "+serialNumber, false)
+						errorln(err.Error(), false)
+						return
+					}
+					_ = recordStep(serialNumber, device, factoryImageHash, StepSystemFlashedSlotA)
 				}
-			}())
-			flashAll.Dir = deviceFactoryFolderMap[device]
-			flashAll.Stderr = os.Stderr
-			flashAll.Stdout = os.Stdout
-			flashAll.Env = append(flashAll.Environ(), "ANDROID_SERIAL="+serialNumber)
-			flashAll.Env = append(flashAll.Environ(), "DEVICE_FLASHER_VERSION="+version)
-			err := flashAll.Run()
-			if err != nil {
-				errorln("Failed to flash "+device+" "+serialNumber, false)
-				errorln(err.Error(), false)
-				return
+			} else {
+				reporter.Warn(serialNumber, "Already flashed per saved checkpoint, skipping")
 			}
 			/*
-			fmt.Println("Locking " + device + " " + serialNumber + " bootloader...")
-			warnln("6. Please use the volume and power keys on the device to lock the bootloader")
-			for i := 0; isNotLocked(serialNumber, device); i++ {
-				if (device == "FP4" || device == "FP5") && getUnlockAbility(serialNumber) != "1" {
-					errorln("Not locking bootloader of "+device+" "+serialNumber, false)
-					errorln("fastboot flashing get_unlock_ability returned 0", false)
-					errorln("Please visit https://calyxos.org/FP4 for more information.", true)
-					return
-				}
-				platformToolCommand = *fastboot
-				platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "flashing", "lock")
-				_ = platformToolCommand.Start()
-				time.Sleep(30 * time.Second)
-				if i >= 2 {
-					if device == "FP4" || device == "FP5" || device == "axolotl" || device == "otter" {
-						errorln("Unable to determine if bootloader was locked", true)
+				fmt.Println("Locking " + device + " " + serialNumber + " bootloader...")
+				warnln("6. Please use the volume and power keys on the device to lock the bootloader")
+				for i := 0; isNotLocked(serialNumber, device); i++ {
+					if (device == "FP4" || device == "FP5") && getUnlockAbility(serialNumber) != "1" {
+						errorln("Not locking bootloader of "+device+" "+serialNumber, false)
+						errorln("fastboot flashing get_unlock_ability returned 0", false)
+						errorln("Please visit https://calyxos.org/FP4 for more information.", true)
+						return
+					}
+					platformToolCommand = *fastboot
+					platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "flashing", "lock")
+					_ = platformToolCommand.Start()
+					time.Sleep(30 * time.Second)
+					if i >= 2 {
+						if device == "FP4" || device == "FP5" || device == "axolotl" || device == "otter" {
+							errorln("Unable to determine if bootloader was locked", true)
+							return
+						}
+						errorln("Failed to lock "+device+" "+serialNumber+" bootloader", false)
 						return
 					}
-					errorln("Failed to lock "+device+" "+serialNumber+" bootloader", false)
-					return
 				}
-			}
 			*/
-			fmt.Println("Rebooting " + device + " " + serialNumber + "...")
-			platformToolCommand = *fastboot
-			platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "reboot")
-			_ = platformToolCommand.Start()
+			reporter.StageChanged(serialNumber, StageReboot)
+			if legacyTools {
+				platformToolCommand = *fastboot
+				platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "reboot")
+				_ = platformToolCommand.Start()
+			} else if client, err := openFastbootDevice(serialNumber); err == nil {
+				_ = client.WithReporter(reporter).Reboot()
+				client.Close()
+			}
+			_ = recordStep(serialNumber, device, factoryImageHash, StepRebooted)
+			if serialConsolePort != "" && len(devices) > 1 {
+				reporter.Warn(serialNumber, "-serial-console names a single port, which can't be shared across "+fmt.Sprint(len(devices))+" devices; skipping boot verification")
+			} else if err := verifyBootCompletion(serialNumber, device, reporter); err != nil {
+				errorln(err.Error(), false)
+				return
+			}
+			reporter.StageChanged(serialNumber, StageDone)
 		}(serialNumber, device)
 	}
 	wg.Wait()
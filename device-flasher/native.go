@@ -0,0 +1,173 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/gousb"
+)
+
+// getDevicesNative enumerates USB devices speaking either the adb or
+// fastboot protocol, in place of parsing `adb devices`/`fastboot devices`
+// output.
+func getDevicesNative() map[string]string {
+	devices := map[string]string{}
+	ctx := gousb.NewContext()
+	defer ctx.Close()
+	found, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool { return true })
+	if err != nil {
+		return devices
+	}
+	for _, usbDevice := range found {
+		serialNumber, err := usbDevice.SerialNumber()
+		usbDevice.Close()
+		if err != nil || serialNumber == "" {
+			continue
+		}
+		var device string
+		if client, adbErr := openAdbDevice(serialNumber); adbErr == nil {
+			device = propFromClient(client, "ro.product.device")
+			client.Close()
+		} else if client, err := openFastbootDevice(serialNumber); err == nil {
+			device = varFromClient(client, "product")
+			if device == "sdm845" {
+				device = "axolotl"
+			}
+			client.Close()
+		} else {
+			if errors.Is(adbErr, errAdbAuthRequired) {
+				warnln(adbErr)
+			}
+			continue
+		}
+		fmt.Print("Detected " + device + " " + serialNumber)
+		if _, ok := deviceFactoryFolderMap[device]; ok {
+			devices[serialNumber] = device
+			fmt.Println()
+		} else {
+			fmt.Println(". " + "No matching factory image found")
+		}
+	}
+	return devices
+}
+
+func getVarNative(prop string, serialNumber string) string {
+	client, err := openFastbootDevice(serialNumber)
+	if err != nil {
+		return ""
+	}
+	defer client.Close()
+	return varFromClient(client, prop)
+}
+
+// varFromClient reads a fastboot variable over an already-open client. It's
+// split out from getVarNative so callers that already hold a client (e.g.
+// getDevicesNative) don't have to open a second one, which would fail to
+// claim the USB interface a first handle still holds.
+func varFromClient(client *fastbootClient, prop string) string {
+	value, err := client.GetVar(prop)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(value)
+}
+
+func getUnlockAbilityNative(serialNumber string) string {
+	client, err := openFastbootDevice(serialNumber)
+	if err != nil {
+		return ""
+	}
+	defer client.Close()
+	value, err := client.FlashingGetUnlockAbility()
+	if err != nil {
+		return ""
+	}
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[len(fields)-1]
+}
+
+func getCriticalUnlockedNative(serialNumber string) string {
+	client, err := openFastbootDevice(serialNumber)
+	if err != nil {
+		return ""
+	}
+	defer client.Close()
+	info, err := client.OemDeviceInfo()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(info, "\n") {
+		if strings.Contains(line, "Device critical unlocked:") {
+			fields := strings.Split(line, " ")
+			return strings.TrimSpace(fields[len(fields)-1])
+		}
+	}
+	return ""
+}
+
+func getPropNative(prop string, serialNumber string) string {
+	client, err := openAdbDevice(serialNumber)
+	if err != nil {
+		return ""
+	}
+	defer client.Close()
+	return propFromClient(client, prop)
+}
+
+// propFromClient reads an adb getprop value over an already-open client.
+// It's split out from getPropNative so callers that already hold a client
+// (e.g. getDevicesNative) don't have to open a second one, which would fail
+// to claim the USB interface a first handle still holds.
+func propFromClient(client *adbClient, prop string) string {
+	out, err := client.Shell("getprop " + prop)
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(out, "[]\n\r")
+}
+
+// flashPartitionNative flashes imagePath to partition on serialNumber,
+// streaming DATA-phase progress through reporter so parallel flashes report
+// real per-device byte counts instead of racing stdout.
+func flashPartitionNative(serialNumber, partition, imagePath string, reporter Reporter) error {
+	client, err := openFastbootDevice(serialNumber)
+	if err != nil {
+		return err
+	}
+	client.WithReporter(reporter)
+	defer client.Close()
+
+	image, err := os.Open(imagePath)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	info, err := image.Stat()
+	if err != nil {
+		return err
+	}
+
+	progress := &reporterProgressWriter{reporter: reporter, serial: serialNumber, partition: partition, total: uint64(info.Size())}
+	return client.Flash(partition, image, info.Size(), progress)
+}
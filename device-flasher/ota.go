@@ -0,0 +1,543 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+)
+
+// Set via flag
+var ota bool
+
+func init() {
+	flag.BoolVar(&ota, "ota", false, "Flash from a full OTA update zip instead of a factory image zip.")
+}
+
+// payload.bin layout, per Android's update_engine:
+//
+//	"CrAU" magic (4 bytes)
+//	version (uint64, big-endian)
+//	manifest size (uint64, big-endian)
+//	metadata signature size (uint32, big-endian, only present when version >= 2)
+//	manifest (protobuf-encoded DeltaArchiveManifest, manifest size bytes)
+//	metadata signature (metadata signature size bytes)
+//	payload data blob
+const payloadMagic = "CrAU"
+
+type payloadHeader struct {
+	Version               uint64
+	ManifestSize          uint64
+	MetadataSignatureSize uint32
+	// DataOffset is the absolute offset of the payload data blob within the
+	// payload.bin file, i.e. where InstallOperation.DataOffset is relative to.
+	DataOffset int64
+}
+
+// Field numbers below mirror update_engine's update_metadata.proto.
+const (
+	fieldManifestBlockSize  = 3
+	fieldManifestPartitions = 13
+
+	fieldPartitionName       = 1
+	fieldPartitionOperations = 8
+
+	fieldOperationType       = 1
+	fieldOperationDataOffset = 2
+	fieldOperationDataLength = 3
+	fieldOperationDstExtents = 6
+
+	fieldExtentStartBlock = 1
+	fieldExtentNumBlocks  = 2
+)
+
+// InstallOperation types we support extracting. MOVE/BSDIFF/SOURCE_COPY and
+// friends require a source image to diff against, which a full OTA doesn't
+// carry, so they're intentionally unsupported here.
+const (
+	opReplace   = 0
+	opReplaceBz = 1
+	opZero      = 6
+	opReplaceXz = 8
+)
+
+type extent struct {
+	StartBlock uint64
+	NumBlocks  uint64
+}
+
+type installOperation struct {
+	Type       uint64
+	DataOffset uint64
+	DataLength uint64
+	DstExtents []extent
+}
+
+type partitionUpdate struct {
+	Name       string
+	Operations []installOperation
+}
+
+type deltaArchiveManifest struct {
+	BlockSize  uint64
+	Partitions []partitionUpdate
+}
+
+func parsePayloadHeader(r io.Reader) (payloadHeader, error) {
+	var header payloadHeader
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return header, err
+	}
+	if string(magic) != payloadMagic {
+		return header, fmt.Errorf("not a payload.bin: bad magic %q", magic)
+	}
+	if err := binary.Read(r, binary.BigEndian, &header.Version); err != nil {
+		return header, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &header.ManifestSize); err != nil {
+		return header, err
+	}
+	offset := int64(4 + 8 + 8)
+	if header.Version >= 2 {
+		if err := binary.Read(r, binary.BigEndian, &header.MetadataSignatureSize); err != nil {
+			return header, err
+		}
+		offset += 4
+	}
+	header.DataOffset = offset + int64(header.ManifestSize) + int64(header.MetadataSignatureSize)
+	return header, nil
+}
+
+// readVarint reads a protobuf base-128 varint starting at data[0].
+func readVarint(data []byte) (uint64, int, error) {
+	var result uint64
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		result |= uint64(b&0x7f) << (7 * uint(i))
+		if b&0x80 == 0 {
+			return result, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("truncated varint")
+}
+
+// protoField is one decoded (fieldNumber, wireType, rawValue) triple from a
+// protobuf message. For varint fields Value holds the decoded integer
+// interpreted as a uint64; for length-delimited fields Bytes holds the raw
+// submessage/string/bytes payload.
+type protoField struct {
+	Number int
+	Value  uint64
+	Bytes  []byte
+}
+
+// parseProtoFields performs a minimal, allocation-light walk of a protobuf
+// message's top-level fields. It understands only the varint (0) and
+// length-delimited (2) wire types, which is all DeltaArchiveManifest uses.
+func parseProtoFields(data []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(data) > 0 {
+		tag, n, err := readVarint(data)
+		if err != nil {
+			return nil, err
+		}
+		data = data[n:]
+		number := int(tag >> 3)
+		wireType := tag & 0x7
+		switch wireType {
+		case 0:
+			v, n, err := readVarint(data)
+			if err != nil {
+				return nil, err
+			}
+			data = data[n:]
+			fields = append(fields, protoField{Number: number, Value: v})
+		case 2:
+			length, n, err := readVarint(data)
+			if err != nil {
+				return nil, err
+			}
+			data = data[n:]
+			if uint64(len(data)) < length {
+				return nil, errors.New("truncated length-delimited field")
+			}
+			fields = append(fields, protoField{Number: number, Bytes: data[:length]})
+			data = data[length:]
+		default:
+			return nil, fmt.Errorf("unsupported protobuf wire type %d", wireType)
+		}
+	}
+	return fields, nil
+}
+
+func parseExtent(data []byte) (extent, error) {
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return extent{}, err
+	}
+	var e extent
+	for _, f := range fields {
+		switch f.Number {
+		case fieldExtentStartBlock:
+			e.StartBlock = f.Value
+		case fieldExtentNumBlocks:
+			e.NumBlocks = f.Value
+		}
+	}
+	return e, nil
+}
+
+func parseInstallOperation(data []byte) (installOperation, error) {
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return installOperation{}, err
+	}
+	var op installOperation
+	for _, f := range fields {
+		switch f.Number {
+		case fieldOperationType:
+			op.Type = f.Value
+		case fieldOperationDataOffset:
+			op.DataOffset = f.Value
+		case fieldOperationDataLength:
+			op.DataLength = f.Value
+		case fieldOperationDstExtents:
+			e, err := parseExtent(f.Bytes)
+			if err != nil {
+				return installOperation{}, err
+			}
+			op.DstExtents = append(op.DstExtents, e)
+		}
+	}
+	return op, nil
+}
+
+func parsePartitionUpdate(data []byte) (partitionUpdate, error) {
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return partitionUpdate{}, err
+	}
+	var p partitionUpdate
+	for _, f := range fields {
+		switch f.Number {
+		case fieldPartitionName:
+			p.Name = string(f.Bytes)
+		case fieldPartitionOperations:
+			op, err := parseInstallOperation(f.Bytes)
+			if err != nil {
+				return partitionUpdate{}, err
+			}
+			p.Operations = append(p.Operations, op)
+		}
+	}
+	return p, nil
+}
+
+func parseManifest(data []byte) (*deltaArchiveManifest, error) {
+	fields, err := parseProtoFields(data)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &deltaArchiveManifest{BlockSize: 4096}
+	for _, f := range fields {
+		switch f.Number {
+		case fieldManifestBlockSize:
+			manifest.BlockSize = f.Value
+		case fieldManifestPartitions:
+			p, err := parsePartitionUpdate(f.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			manifest.Partitions = append(manifest.Partitions, p)
+		}
+	}
+	return manifest, nil
+}
+
+// extractOtaPartitions reads payloadPath, a full OTA's payload.bin, and
+// writes one sparse <partition>.img file per partition into destination, returning a
+// map of partition name to the extracted image path.
+func extractOtaPartitions(payloadPath string, destination string) (map[string]string, error) {
+	f, err := os.Open(payloadPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header, err := parsePayloadHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	manifestBytes := make([]byte, header.ManifestSize)
+	if _, err := io.ReadFull(f, manifestBytes); err != nil {
+		return nil, err
+	}
+	manifest, err := parseManifest(manifestBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	images := map[string]string{}
+	for _, partition := range manifest.Partitions {
+		imagePath := filepath.Join(destination, partition.Name+".img")
+		if err := writePartitionImage(f, header, manifest.BlockSize, partition, imagePath); err != nil {
+			return nil, fmt.Errorf("extracting %s: %w", partition.Name, err)
+		}
+		images[partition.Name] = imagePath
+	}
+	return images, nil
+}
+
+func writePartitionImage(payload *os.File, header payloadHeader, blockSize uint64, partition partitionUpdate, imagePath string) error {
+	out, err := os.OpenFile(imagePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	for _, op := range partition.Operations {
+		if err := writeInstallOperation(payload, header, op, out, blockSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeInstallOperation applies a single InstallOperation to out. An
+// operation's dst_extents are not necessarily contiguous (ZERO operations in
+// particular routinely cover several disjoint block ranges), so each extent
+// is written at its own StartBlock*blockSize offset rather than as one
+// contiguous range starting at the first extent.
+func writeInstallOperation(payload *os.File, header payloadHeader, op installOperation, out *os.File, blockSize uint64) error {
+	if op.Type == opZero {
+		// Leave a hole: writing a sparse file means we don't need to
+		// actually zero-fill it, but seeking past the end of each extent
+		// makes sure the file covers it.
+		for _, e := range op.DstExtents {
+			length := int64(e.NumBlocks * blockSize)
+			if length == 0 {
+				continue
+			}
+			if _, err := out.Seek(int64(e.StartBlock*blockSize)+length-1, io.SeekStart); err != nil {
+				return err
+			}
+			if _, err := out.Write([]byte{0}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	data := make([]byte, op.DataLength)
+	if _, err := payload.ReadAt(data, header.DataOffset+int64(op.DataOffset)); err != nil {
+		return err
+	}
+
+	var r io.Reader
+	switch op.Type {
+	case opReplace:
+		r = bytes.NewReader(data)
+	case opReplaceBz:
+		r = bzip2.NewReader(bytes.NewReader(data))
+	case opReplaceXz:
+		xzr, err := xz.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		r = xzr
+	default:
+		return fmt.Errorf("unsupported InstallOperation type %d", op.Type)
+	}
+
+	// The decompressed stream maps sequentially across the (possibly
+	// disjoint) destination extents, in order. The last extent of an
+	// operation isn't always filled to its full block length (a partition's
+	// final block can be padding), so running out of data there is expected;
+	// anywhere else it's a malformed payload.
+	for i, e := range op.DstExtents {
+		extentLength := int64(e.NumBlocks * blockSize)
+		if _, err := out.Seek(int64(e.StartBlock*blockSize), io.SeekStart); err != nil {
+			return err
+		}
+		n, err := io.CopyN(out, r, extentLength)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n < extentLength {
+			if i < len(op.DstExtents)-1 {
+				return fmt.Errorf("InstallOperation data ran out in extent %d of %d", i+1, len(op.DstExtents))
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// getOtaFolders scans cwd for Android OTA update zips (identified by
+// containing payload.bin and payload_properties.txt), verifies each zip's
+// signature the same way getFactoryFolders does, and, for each device
+// codename found in the zip name, extracts the payload into a per-device
+// folder under destination, ready to be flashed partition-by-partition.
+func getOtaFolders() map[string]string {
+	files, err := ioutil.ReadDir(cwd)
+	if err != nil {
+		errorln(err, true)
+	}
+	deviceOtaFolderMap := map[string]string{}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".zip") {
+			continue
+		}
+		if err := verifyImageSignature(filepath.Join(cwd, name)); err != nil {
+			errorln("Cannot continue without a verified OTA image. Exiting...", false)
+			errorln(err, true)
+		}
+		extracted, err := extractZip(name, cwd)
+		if err != nil {
+			continue
+		}
+		payloadPath, ok := findExtractedFile(extracted, "payload.bin")
+		if !ok || !containsOtaPayload(extracted) {
+			continue
+		}
+		device := strings.Split(name, "-")[0]
+		destination := filepath.Join(cwd, device+"-ota")
+		if err := os.MkdirAll(destination, os.ModePerm); err != nil {
+			errorln(err, true)
+		}
+		images, err := extractOtaPartitions(payloadPath, destination)
+		if err != nil {
+			errorln("Cannot continue without a valid OTA payload. Exiting...", false)
+			errorln(err, true)
+		}
+		if len(images) > 0 {
+			deviceOtaFolderMap[device] = destination
+		}
+	}
+	return deviceOtaFolderMap
+}
+
+// flashOtaPartitions flashes every previously extracted partition image in
+// otaFolder onto serialNumber via fastboot, reporting each partition's
+// progress through reporter, then marks the slot it just flashed as active.
+// It checkpoints the bootloader and radio partitions individually, since
+// those are the ones most likely to leave a device in a bad state if
+// interrupted, and skips re-flashing them on resume if resumeFrom shows
+// they're already done.
+func flashOtaPartitions(serialNumber, device, otaFolder, factoryImageSHA256 string, resumeFrom Step, reporter Reporter) error {
+	images, err := ioutil.ReadDir(otaFolder)
+	if err != nil {
+		return err
+	}
+	for _, image := range images {
+		if !strings.HasSuffix(image.Name(), ".img") {
+			continue
+		}
+		partition := strings.TrimSuffix(image.Name(), ".img")
+		imagePath := filepath.Join(otaFolder, image.Name())
+		if partition == "bootloader" && stepIndex(resumeFrom) >= stepIndex(StepBootloaderFlashed) {
+			continue
+		}
+		if (partition == "radio" || partition == "modem") && stepIndex(resumeFrom) >= stepIndex(StepRadioFlashed) {
+			continue
+		}
+		switch {
+		case partition == "bootloader":
+			reporter.StageChanged(serialNumber, StageFlashingBootloader)
+		case partition == "radio" || partition == "modem":
+			reporter.StageChanged(serialNumber, StageFlashingRadio)
+		default:
+			reporter.StageChanged(serialNumber, StageFlashingSystem)
+		}
+		if legacyTools {
+			platformToolCommand := *fastboot
+			platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "flash", partition, imagePath)
+			platformToolCommand.Stderr = os.Stderr
+			platformToolCommand.Stdout = os.Stdout
+			if err := platformToolCommand.Run(); err != nil {
+				return fmt.Errorf("flashing %s: %w", partition, err)
+			}
+		} else if err := flashPartitionNative(serialNumber, partition, imagePath, reporter); err != nil {
+			return fmt.Errorf("flashing %s: %w", partition, err)
+		}
+		switch {
+		case partition == "bootloader":
+			_ = recordStep(serialNumber, device, factoryImageSHA256, StepBootloaderFlashed)
+		case partition == "radio" || partition == "modem":
+			_ = recordStep(serialNumber, device, factoryImageSHA256, StepRadioFlashed)
+		}
+	}
+	if legacyTools {
+		platformToolCommand := *fastboot
+		platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "--set-active=a")
+		platformToolCommand.Stderr = os.Stderr
+		platformToolCommand.Stdout = os.Stdout
+		if err := platformToolCommand.Run(); err != nil {
+			return err
+		}
+		_ = recordStep(serialNumber, device, factoryImageSHA256, StepSystemFlashedSlotA)
+		return nil
+	}
+	client, err := openFastbootDevice(serialNumber)
+	if err != nil {
+		return err
+	}
+	client.WithReporter(reporter)
+	defer client.Close()
+	if err := client.SetActive("a"); err != nil {
+		return err
+	}
+	_ = recordStep(serialNumber, device, factoryImageSHA256, StepSystemFlashedSlotA)
+	return nil
+}
+
+// findExtractedFile returns the path extractZip wrote for name, since an OTA
+// zip's payload.bin must be read back from wherever it was just extracted to,
+// not assumed to live in cwd alongside every other zip being processed.
+func findExtractedFile(files []string, name string) (string, bool) {
+	for _, f := range files {
+		if filepath.Base(f) == name {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+func containsOtaPayload(files []string) bool {
+	var hasPayload, hasProperties bool
+	for _, f := range files {
+		switch filepath.Base(f) {
+		case "payload.bin":
+			hasPayload = true
+		case "payload_properties.txt":
+			hasProperties = true
+		}
+	}
+	return hasPayload && hasProperties
+}
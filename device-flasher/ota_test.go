@@ -0,0 +1,145 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// putVarint appends v to buf as a protobuf base-128 varint.
+func putVarint(buf *bytes.Buffer, v uint64) {
+	for v >= 0x80 {
+		buf.WriteByte(byte(v&0x7f) | 0x80)
+		v >>= 7
+	}
+	buf.WriteByte(byte(v))
+}
+
+func putTag(buf *bytes.Buffer, field int, wireType uint64) {
+	putVarint(buf, uint64(field)<<3|wireType)
+}
+
+func putLengthDelimited(buf *bytes.Buffer, field int, data []byte) {
+	putTag(buf, field, 2)
+	putVarint(buf, uint64(len(data)))
+	buf.Write(data)
+}
+
+func putVarintField(buf *bytes.Buffer, field int, v uint64) {
+	putTag(buf, field, 0)
+	putVarint(buf, v)
+}
+
+func buildTestExtent(startBlock, numBlocks uint64) []byte {
+	var buf bytes.Buffer
+	putVarintField(&buf, fieldExtentStartBlock, startBlock)
+	putVarintField(&buf, fieldExtentNumBlocks, numBlocks)
+	return buf.Bytes()
+}
+
+func buildTestOperation(opType uint64, dataOffset, dataLength uint64, dstExtent []byte) []byte {
+	var buf bytes.Buffer
+	putVarintField(&buf, fieldOperationType, opType)
+	putVarintField(&buf, fieldOperationDataOffset, dataOffset)
+	putVarintField(&buf, fieldOperationDataLength, dataLength)
+	putLengthDelimited(&buf, fieldOperationDstExtents, dstExtent)
+	return buf.Bytes()
+}
+
+func buildTestPartition(name string, operations ...[]byte) []byte {
+	var buf bytes.Buffer
+	putLengthDelimited(&buf, fieldPartitionName, []byte(name))
+	for _, op := range operations {
+		putLengthDelimited(&buf, fieldPartitionOperations, op)
+	}
+	return buf.Bytes()
+}
+
+func buildTestManifest(blockSize uint64, partitions ...[]byte) []byte {
+	var buf bytes.Buffer
+	putVarintField(&buf, fieldManifestBlockSize, blockSize)
+	for _, p := range partitions {
+		putLengthDelimited(&buf, fieldManifestPartitions, p)
+	}
+	return buf.Bytes()
+}
+
+// buildTestPayload assembles a minimal but well-formed payload.bin containing
+// a single "boot" partition with one REPLACE operation writing payloadData at
+// block 0.
+func buildTestPayload(t *testing.T, blockSize uint64, payloadData []byte) []byte {
+	t.Helper()
+	extent := buildTestExtent(0, (uint64(len(payloadData))+blockSize-1)/blockSize)
+	operation := buildTestOperation(opReplace, 0, uint64(len(payloadData)), extent)
+	partition := buildTestPartition("boot", operation)
+	manifest := buildTestManifest(blockSize, partition)
+
+	var buf bytes.Buffer
+	buf.WriteString(payloadMagic)
+	_ = binary.Write(&buf, binary.BigEndian, uint64(2))
+	_ = binary.Write(&buf, binary.BigEndian, uint64(len(manifest)))
+	_ = binary.Write(&buf, binary.BigEndian, uint32(0))
+	buf.Write(manifest)
+	buf.Write(payloadData)
+	return buf.Bytes()
+}
+
+func TestParsePayloadHeader(t *testing.T) {
+	payload := buildTestPayload(t, 4096, []byte("hello partition data"))
+	header, err := parsePayloadHeader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("parsePayloadHeader: %v", err)
+	}
+	if header.Version != 2 {
+		t.Errorf("Version = %d, want 2", header.Version)
+	}
+	if header.MetadataSignatureSize != 0 {
+		t.Errorf("MetadataSignatureSize = %d, want 0", header.MetadataSignatureSize)
+	}
+}
+
+func TestExtractOtaPartitions(t *testing.T) {
+	want := []byte("hello partition data")
+	payload := buildTestPayload(t, 4096, want)
+
+	dir := t.TempDir()
+	payloadPath := filepath.Join(dir, "payload.bin")
+	if err := ioutil.WriteFile(payloadPath, payload, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	images, err := extractOtaPartitions(payloadPath, dir)
+	if err != nil {
+		t.Fatalf("extractOtaPartitions: %v", err)
+	}
+	bootImage, ok := images["boot"]
+	if !ok {
+		t.Fatalf("images = %v, want \"boot\" entry", images)
+	}
+
+	got, err := os.ReadFile(bootImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:len(want)], want) {
+		t.Errorf("extracted boot image = %q, want prefix %q", got[:len(want)], want)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Set via flag
+var logJSON bool
+
+func init() {
+	flag.BoolVar(&logJSON, "log-json", false, "Emit one JSON event per line instead of the interactive dashboard, for CI consumption.")
+}
+
+// Stage is a step in a single device's flash sequence, in the order it's
+// expected to occur.
+type Stage string
+
+const (
+	StageUnlock             Stage = "unlock"
+	StageFlashingBootloader Stage = "flashing bootloader"
+	StageFlashingRadio      Stage = "flashing radio"
+	StageFlashingSystem     Stage = "flashing system"
+	StageRelock             Stage = "relock"
+	StageReboot             Stage = "reboot"
+	StageVerifyingBoot      Stage = "verifying boot"
+	StageDone               Stage = "done"
+	StageFailed             Stage = "failed"
+)
+
+// Reporter receives flash progress events from flashDevices, one instance
+// shared across every device's goroutine. Implementations must be safe for
+// concurrent use, since -parallel flashes several devices at once.
+type Reporter interface {
+	StageChanged(serial string, stage Stage)
+	Progress(serial, partition string, done, total uint64)
+	Warn(serial, msg string)
+	Fail(serial string, err error)
+}
+
+// newReporter picks JSONReporter when -log-json is set, otherwise TUIReporter
+// when stdout looks like a terminal, falling back to JSONReporter so output
+// redirected to a file or CI log stays line-oriented.
+func newReporter(devices map[string]string) Reporter {
+	if logJSON || !stdoutIsTerminal() {
+		return NewJSONReporter()
+	}
+	return NewTUIReporter(devices)
+}
+
+func stdoutIsTerminal() bool {
+	info, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// JSONReporter emits one JSON object per line, e.g. for CI consumption.
+type JSONReporter struct {
+	mu sync.Mutex
+}
+
+func NewJSONReporter() *JSONReporter {
+	return &JSONReporter{}
+}
+
+type jsonEvent struct {
+	Time      time.Time `json:"time"`
+	Serial    string    `json:"serial"`
+	Event     string    `json:"event"`
+	Stage     Stage     `json:"stage,omitempty"`
+	Partition string    `json:"partition,omitempty"`
+	Done      uint64    `json:"done,omitempty"`
+	Total     uint64    `json:"total,omitempty"`
+	Message   string    `json:"message,omitempty"`
+}
+
+func (r *JSONReporter) emit(e jsonEvent) {
+	e.Time = time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_ = json.NewEncoder(os.Stdout).Encode(e)
+}
+
+func (r *JSONReporter) StageChanged(serial string, stage Stage) {
+	r.emit(jsonEvent{Serial: serial, Event: "stage", Stage: stage})
+}
+
+func (r *JSONReporter) Progress(serial, partition string, done, total uint64) {
+	r.emit(jsonEvent{Serial: serial, Event: "progress", Partition: partition, Done: done, Total: total})
+}
+
+func (r *JSONReporter) Warn(serial, msg string) {
+	r.emit(jsonEvent{Serial: serial, Event: "warn", Message: msg})
+}
+
+func (r *JSONReporter) Fail(serial string, err error) {
+	r.emit(jsonEvent{Serial: serial, Event: "fail", Message: err.Error()})
+}
+
+// deviceRow is one device's row in the TUI dashboard.
+type deviceRow struct {
+	device    string
+	stage     Stage
+	partition string
+	done      uint64
+	total     uint64
+	warning   string
+	err       error
+	started   time.Time
+}
+
+// TUIReporter renders one row per device, redrawing in place with ANSI
+// cursor movement, similar in spirit to WriteCounter's carriage-return
+// progress but extended to several concurrent lines.
+type TUIReporter struct {
+	mu    sync.Mutex
+	order []string
+	rows  map[string]*deviceRow
+	drawn int
+}
+
+func NewTUIReporter(devices map[string]string) *TUIReporter {
+	r := &TUIReporter{rows: map[string]*deviceRow{}}
+	serials := make([]string, 0, len(devices))
+	for serial := range devices {
+		serials = append(serials, serial)
+	}
+	sort.Strings(serials)
+	for _, serial := range serials {
+		r.order = append(r.order, serial)
+		r.rows[serial] = &deviceRow{device: devices[serial], started: time.Now()}
+	}
+	r.redraw()
+	return r
+}
+
+func (r *TUIReporter) StageChanged(serial string, stage Stage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if row, ok := r.rows[serial]; ok {
+		row.stage = stage
+	}
+	r.redraw()
+}
+
+func (r *TUIReporter) Progress(serial, partition string, done, total uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if row, ok := r.rows[serial]; ok {
+		row.partition = partition
+		row.done = done
+		row.total = total
+	}
+	r.redraw()
+}
+
+func (r *TUIReporter) Warn(serial, msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if row, ok := r.rows[serial]; ok {
+		row.warning = msg
+	}
+	r.redraw()
+}
+
+func (r *TUIReporter) Fail(serial string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if row, ok := r.rows[serial]; ok {
+		row.stage = StageFailed
+		row.err = err
+	}
+	r.redraw()
+}
+
+// redraw must be called with r.mu held. It moves the cursor back up to the
+// start of the dashboard (if it has already been drawn once) and reprints
+// every row.
+func (r *TUIReporter) redraw() {
+	if r.drawn > 0 {
+		fmt.Printf("\033[%dA", r.drawn)
+	}
+	for _, serial := range r.order {
+		row := r.rows[serial]
+		fmt.Printf("\033[2K\r%s\n", formatDeviceRow(serial, row))
+	}
+	r.drawn = len(r.order)
+}
+
+// reporterProgressWriter adapts a Reporter's Progress callback to an
+// io.Writer, so it can be passed anywhere flashDevices currently passes a
+// *WriteCounter, e.g. fastbootClient.Flash.
+type reporterProgressWriter struct {
+	reporter  Reporter
+	serial    string
+	partition string
+	total     uint64
+	done      uint64
+}
+
+func (w *reporterProgressWriter) Write(p []byte) (int, error) {
+	w.done += uint64(len(p))
+	w.reporter.Progress(w.serial, w.partition, w.done, w.total)
+	return len(p), nil
+}
+
+func formatDeviceRow(serial string, row *deviceRow) string {
+	elapsed := time.Since(row.started).Round(time.Second)
+	var progress string
+	if row.total > 0 {
+		progress = fmt.Sprintf(" %s %s/%s", row.partition, Bytes(row.done), Bytes(row.total))
+	}
+	status := string(row.stage)
+	if status == "" {
+		status = "waiting"
+	}
+	line := fmt.Sprintf("%-12s %-10s %-22s%s  %s", serial, row.device, status, progress, elapsed)
+	if row.err != nil {
+		line += "  " + Error("error: "+row.err.Error())
+	} else if row.warning != "" {
+		line += "  " + Warn(row.warning)
+	}
+	return strings.TrimRight(line, " ")
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Set via flag
+var serialConsolePort string
+
+// Set via flag
+var bootSignature string
+
+const bootVerifyTimeout = 5 * time.Minute
+
+func init() {
+	flag.StringVar(&serialConsolePort, "serial-console", "", "Path to a USB-serial adapter attached to the device's console (e.g. /dev/ttyUSB0), to confirm it actually boots after flashing. Boot verification is skipped if unset.")
+	flag.StringVar(&bootSignature, "boot-signature", "", "Regex to look for in the serial console log to recognize a completed boot, instead of the built-in Android/Fuchsia signatures.")
+}
+
+// defaultBootSignatures recognizes a completed boot on the platforms this
+// flasher targets: Android's boot-completed property showing up in a logcat
+// or console stream, and Fuchsia/Zircon's console welcome banner.
+var defaultBootSignatures = []*regexp.Regexp{
+	regexp.MustCompile(`sys\.boot_completed\s*[=:]\s*1`),
+	regexp.MustCompile(`(?i)welcome to zircon`),
+}
+
+// resolveSerialConsolePort returns the port to listen on. There's no safe way
+// to auto-detect which attached USB-serial adapter, if any, is actually wired
+// to a given device's console, so boot verification only runs when
+// -serial-console names one explicitly.
+func resolveSerialConsolePort() (string, bool) {
+	return serialConsolePort, serialConsolePort != ""
+}
+
+// verifyBootCompletion attaches to the serial console named by
+// -serial-console and waits up to bootVerifyTimeout for a boot-completion
+// signature to appear in the log stream. If no console is configured, it's a
+// no-op: this check is an optional extra layer of confidence, not a
+// requirement to flash a device. On timeout, the last 200 lines read are
+// appended to error.log and the device is marked failed via reporter.
+func verifyBootCompletion(serialNumber, device string, reporter Reporter) error {
+	port, ok := resolveSerialConsolePort()
+	if !ok {
+		return nil
+	}
+
+	signatures := defaultBootSignatures
+	if bootSignature != "" {
+		re, err := regexp.Compile(bootSignature)
+		if err != nil {
+			return fmt.Errorf("invalid -boot-signature: %w", err)
+		}
+		signatures = []*regexp.Regexp{re}
+	}
+
+	console, err := serial.Open(port, &serial.Mode{BaudRate: 115200})
+	if err != nil {
+		reporter.Warn(serialNumber, "could not open serial console "+port+": "+err.Error())
+		return nil
+	}
+	defer console.Close()
+	_ = console.SetReadTimeout(2 * time.Second)
+
+	reporter.StageChanged(serialNumber, StageVerifyingBoot)
+
+	var lastLines []string
+	var partial []byte
+	buf := make([]byte, 4096)
+	deadline := time.Now().Add(bootVerifyTimeout)
+	for time.Now().Before(deadline) {
+		n, err := console.Read(buf)
+		if err != nil {
+			reporter.Warn(serialNumber, "serial console read error: "+err.Error())
+			break
+		}
+		if n == 0 {
+			continue // this Read's 2s timeout elapsed with nothing received
+		}
+		partial = append(partial, buf[:n]...)
+		for {
+			i := bytes.IndexByte(partial, '\n')
+			if i < 0 {
+				break
+			}
+			line := strings.TrimRight(string(partial[:i]), "\r")
+			partial = partial[i+1:]
+			lastLines = appendCapped(lastLines, line, 200)
+			for _, re := range signatures {
+				if re.MatchString(line) {
+					return nil
+				}
+			}
+		}
+	}
+
+	dumpSerialLog(device, serialNumber, lastLines)
+	err = fmt.Errorf("%s %s did not show a boot-completion signature on %s within %s", device, serialNumber, port, bootVerifyTimeout)
+	reporter.Fail(serialNumber, err)
+	return err
+}
+
+func appendCapped(lines []string, line string, max int) []string {
+	lines = append(lines, line)
+	if len(lines) > max {
+		lines = lines[len(lines)-max:]
+	}
+	return lines
+}
+
+func dumpSerialLog(device, serialNumber string, lines []string) {
+	log, err := os.OpenFile("error.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return
+	}
+	defer log.Close()
+	fmt.Fprintf(log, "---- last %d lines of serial console for %s %s ----\n", len(lines), device, serialNumber)
+	for _, line := range lines {
+		fmt.Fprintln(log, line)
+	}
+}
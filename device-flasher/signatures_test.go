@@ -0,0 +1,108 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+func buildMinisignPublicKey(t *testing.T, keyID [8]byte, pub ed25519.PublicKey) []byte {
+	t.Helper()
+	blob := append([]byte("Ed"), keyID[:]...)
+	blob = append(blob, pub...)
+	var out bytes.Buffer
+	out.WriteString("untrusted comment: minisign public key\n")
+	out.WriteString(base64.StdEncoding.EncodeToString(blob))
+	out.WriteString("\n")
+	return out.Bytes()
+}
+
+func buildMinisignSignature(t *testing.T, algorithm string, keyID [8]byte, sig []byte) []byte {
+	t.Helper()
+	blob := append([]byte(algorithm), keyID[:]...)
+	blob = append(blob, sig...)
+	var out bytes.Buffer
+	out.WriteString("untrusted comment: signature\n")
+	out.WriteString(base64.StdEncoding.EncodeToString(blob))
+	out.WriteString("\n")
+	return out.Bytes()
+}
+
+func TestParseMinisignPublicKeyAndSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	message := []byte("factory image contents")
+	sig := ed25519.Sign(priv, message)
+
+	pubKeyID, parsedPub, err := parseMinisignPublicKey(buildMinisignPublicKey(t, keyID, pub))
+	if err != nil {
+		t.Fatalf("parseMinisignPublicKey: %v", err)
+	}
+	if pubKeyID != string(keyID[:]) {
+		t.Errorf("key ID = %x, want %x", pubKeyID, keyID)
+	}
+	if !bytes.Equal(parsedPub, pub) {
+		t.Errorf("public key mismatch")
+	}
+
+	sigKeyID, prehashed, parsedSig, err := parseMinisignSignature(buildMinisignSignature(t, "Ed", keyID, sig))
+	if err != nil {
+		t.Fatalf("parseMinisignSignature: %v", err)
+	}
+	if sigKeyID != string(keyID[:]) {
+		t.Errorf("signature key ID = %x, want %x", sigKeyID, keyID)
+	}
+	if prehashed {
+		t.Error("prehashed = true for an \"Ed\" signature, want false")
+	}
+	if !ed25519.Verify(parsedPub, message, parsedSig) {
+		t.Error("signature failed to verify with round-tripped key/signature")
+	}
+}
+
+func TestParseMinisignSignaturePrehashed(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	message := []byte("factory image contents")
+	sum := blake2b.Sum512(message)
+	sig := ed25519.Sign(priv, sum[:])
+
+	sigKeyID, prehashed, parsedSig, err := parseMinisignSignature(buildMinisignSignature(t, "ED", keyID, sig))
+	if err != nil {
+		t.Fatalf("parseMinisignSignature: %v", err)
+	}
+	if sigKeyID != string(keyID[:]) {
+		t.Errorf("signature key ID = %x, want %x", sigKeyID, keyID)
+	}
+	if !prehashed {
+		t.Error("prehashed = false for an \"ED\" signature, want true")
+	}
+	if !ed25519.Verify(pub, sum[:], parsedSig) {
+		t.Error("signature failed to verify with round-tripped key/signature")
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Step is one atomic, checkpointed point in a device's flash sequence. The
+// zero value means "nothing recorded yet".
+type Step string
+
+const (
+	StepUnlocked           Step = "unlocked"
+	StepCriticalUnlocked   Step = "critical_unlocked"
+	StepBootloaderFlashed  Step = "bootloader_flashed"
+	StepRadioFlashed       Step = "radio_flashed"
+	StepSystemFlashedSlotA Step = "system_flashed_slot_a"
+	StepSystemFlashedSlotB Step = "system_flashed_slot_b"
+	StepRelocked           Step = "relocked"
+	StepRebooted           Step = "rebooted"
+)
+
+// stepOrder is the sequence flashDevices is expected to pass through. It's
+// used only to compare how far along two steps are; it isn't necessarily the
+// set of steps any single device passes through (e.g. slot B is only ever
+// recorded for devices with two flashable slots).
+var stepOrder = []Step{
+	StepUnlocked,
+	StepCriticalUnlocked,
+	StepBootloaderFlashed,
+	StepRadioFlashed,
+	StepSystemFlashedSlotA,
+	StepSystemFlashedSlotB,
+	StepRelocked,
+	StepRebooted,
+}
+
+func stepIndex(step Step) int {
+	for i, s := range stepOrder {
+		if s == step {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkpoint is the on-disk, per-device resume state, written after every
+// completed Step so a crashed or interrupted run can pick back up instead of
+// re-unlocking or re-flashing a partially-flashed device.
+type checkpoint struct {
+	Serial             string    `json:"serial"`
+	Device             string    `json:"device"`
+	Step               Step      `json:"step"`
+	FactoryImageSHA256 string    `json:"factory_image_sha256"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+// Set via flag
+var resetStateSerial string
+
+func init() {
+	flag.StringVar(&resetStateSerial, "reset-state", "", "Delete the saved resume checkpoint for the given device serial, then start flashing it from scratch.")
+}
+
+func stateDir() string {
+	return filepath.Join(cwd, ".flasher-state")
+}
+
+func checkpointPath(serial string) string {
+	return filepath.Join(stateDir(), serial+".json")
+}
+
+// loadCheckpoint returns the saved checkpoint for serial, or nil if none
+// exists.
+func loadCheckpoint(serial string) (*checkpoint, error) {
+	data, err := ioutil.ReadFile(checkpointPath(serial))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+func saveCheckpoint(cp *checkpoint) error {
+	if err := os.MkdirAll(stateDir(), os.ModePerm); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(checkpointPath(cp.Serial), data, 0644)
+}
+
+// recordStep persists that serial has just completed step, overwriting any
+// earlier checkpoint for the same device.
+func recordStep(serial, device, factoryImageSHA256 string, step Step) error {
+	return saveCheckpoint(&checkpoint{
+		Serial:             serial,
+		Device:             device,
+		Step:               step,
+		FactoryImageSHA256: factoryImageSHA256,
+		UpdatedAt:          time.Now(),
+	})
+}
+
+func removeCheckpoint(serial string) error {
+	err := os.Remove(checkpointPath(serial))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// factoryImageSHA256 hashes the factory or OTA zip this device was matched
+// against, so a checkpoint can be invalidated if a different image is dropped
+// into cwd before resuming.
+func factoryImageSHA256(device string) (string, error) {
+	files, err := ioutil.ReadDir(cwd)
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".zip") || strings.Split(name, "-")[0] != device {
+			continue
+		}
+		return fileSHA256(filepath.Join(cwd, name))
+	}
+	return "", fmt.Errorf("no factory image zip found for %s", device)
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// reconcileState loads serial's saved checkpoint, if any, and cross-checks it
+// against the device's actual state before trusting it: a checkpoint for a
+// different factory image, or one that claims the bootloader is unlocked when
+// the device reports otherwise, is discarded rather than resumed from. It
+// returns the step to resume from, or "" to run the whole sequence.
+func reconcileState(serialNumber, device, factoryImageSHA256 string) Step {
+	cp, err := loadCheckpoint(serialNumber)
+	if err != nil || cp == nil {
+		return ""
+	}
+	if factoryImageSHA256 == "" || cp.FactoryImageSHA256 != factoryImageSHA256 {
+		warnln("Saved checkpoint for " + serialNumber + " is for a different factory image, starting over")
+		_ = removeCheckpoint(serialNumber)
+		return ""
+	}
+	if stepIndex(cp.Step) >= stepIndex(StepUnlocked) && isNotUnlocked(serialNumber, device) {
+		warnln("Saved checkpoint for " + serialNumber + " claims the bootloader is unlocked, but the device disagrees; starting over")
+		_ = removeCheckpoint(serialNumber)
+		return ""
+	}
+	if cp.Step == StepRebooted && getProp("ro.build.fingerprint", serialNumber) == "" {
+		warnln("Saved checkpoint for " + serialNumber + " claims flashing finished, but the device hasn't booted; resuming from the last flash step")
+		return StepSystemFlashedSlotA
+	}
+	return cp.Step
+}
+
+// applyResetState handles -reset-state before any device is touched.
+func applyResetState() {
+	if resetStateSerial == "" {
+		return
+	}
+	if err := removeCheckpoint(resetStateSerial); err != nil {
+		errorln(errors.New("failed to reset saved state for "+resetStateSerial+": "+err.Error()), false)
+		return
+	}
+	warnln("Cleared saved resume state for " + resetStateSerial)
+}